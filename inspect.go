@@ -0,0 +1,131 @@
+package main
+
+import (
+	"debug/buildinfo"
+	"io/fs"
+	"path/filepath"
+)
+
+// program describes a single Go-built executable found under GOBIN.
+type program struct {
+	execPath    string // path to the binary on disk
+	modPath     string // module path, e.g. "github.com/davecheney/httpstat"
+	modVersion  string // module version the binary was built from
+	goVersion   string // Go toolchain version used to build the binary
+	goos        string // GOOS the binary was built for
+	goarch      string // GOARCH the binary was built for
+	vcsRevision string // vcs.revision setting, if the build recorded one
+	vcsTime     string // vcs.time setting, if the build recorded one
+	vcsModified bool   // vcs.modified setting
+	settings    buildSettings
+	deps        []moduleInfo
+}
+
+// moduleInfo is a single entry from a binary's dependency graph.
+type moduleInfo struct {
+	path    string
+	version string
+	sum     string
+}
+
+// buildSettings captures the subset of debug.BuildInfo.Settings that
+// affects how a binary is reproduced with "go install".
+type buildSettings struct {
+	tags      string
+	ldflags   string
+	trimpath  bool
+	buildmode string
+	env       []string // extra environment variables, e.g. "CGO_ENABLED=0"
+}
+
+// installArgs returns the extra "go install" flags needed to reproduce the
+// settings bs was built from.
+func (bs buildSettings) installArgs() []string {
+	var args []string
+	if bs.trimpath {
+		args = append(args, "-trimpath")
+	}
+	if bs.tags != "" {
+		args = append(args, "-tags="+bs.tags)
+	}
+	if bs.ldflags != "" {
+		args = append(args, "-ldflags="+bs.ldflags)
+	}
+	if bs.buildmode != "" && bs.buildmode != "exe" {
+		args = append(args, "-buildmode="+bs.buildmode)
+	}
+	return args
+}
+
+// newProgram builds a program from path and the build info read from it,
+// picking apart bi.Settings and bi.Deps into the fields the rest of this
+// tool needs.
+func newProgram(path string, bi *buildinfo.BuildInfo) program {
+	p := program{
+		execPath:   path,
+		modPath:    bi.Main.Path,
+		modVersion: bi.Main.Version,
+		goVersion:  bi.GoVersion,
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "-tags":
+			p.settings.tags = s.Value
+		case "-ldflags":
+			p.settings.ldflags = s.Value
+		case "-trimpath":
+			p.settings.trimpath = s.Value == "true"
+		case "-buildmode":
+			p.settings.buildmode = s.Value
+		case "CGO_ENABLED", "GOAMD64", "GOARM", "GOARM64", "GO386", "GOMIPS", "GOMIPS64", "GOPPC64", "GOWASM":
+			if s.Value != "" {
+				p.settings.env = append(p.settings.env, s.Key+"="+s.Value)
+			}
+		case "GOOS":
+			p.goos = s.Value
+		case "GOARCH":
+			p.goarch = s.Value
+		case "vcs.revision":
+			p.vcsRevision = s.Value
+		case "vcs.time":
+			p.vcsTime = s.Value
+		case "vcs.modified":
+			p.vcsModified = s.Value == "true"
+		}
+	}
+	for _, d := range bi.Deps {
+		m := d
+		if d.Replace != nil {
+			m = d.Replace
+		}
+		p.deps = append(p.deps, moduleInfo{path: m.Path, version: m.Version, sum: m.Sum})
+	}
+	return p
+}
+
+// inspectGobin walks dir and returns one program per regular file that
+// carries Go build information, as reported by debug/buildinfo. Files that
+// are not Go executables (shell scripts, binaries produced by other
+// toolchains, directories, etc.) are skipped silently.
+func inspectGobin(dir string) ([]program, error) {
+	var out []program
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		bi, err := buildinfo.ReadFile(path)
+		if err != nil {
+			// not a Go executable, or buildinfo otherwise unreadable; skip it
+			return nil
+		}
+		out = append(out, newProgram(path, bi))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -1,64 +1,114 @@
 // rebuild-gobin rebuilds binaries under GOBIN if they were built with a Go
 // version different from the currently installed.
 //
-// Tool first scans $GOBIN directory (defaults to $GOPATH/bin or $HOME/go/bin)
-// with the "go version -m" command to figure out module version and Go version
-// for each binary, then runs "go install path@version" for each command's
-// path.
+// Tool first scans $GOBIN directory (defaults to $GOPATH/bin or $HOME/go/bin),
+// reading each file's embedded build information with debug/buildinfo to
+// figure out the module path, module version and Go version used to produce
+// it, then runs "go install path@version" for each command's path.
 //
-// For example, if there's a httpstat binary inside a GOBIN directory, then "go
-// version -m $(which httpstat)" outputs something like this:
+// For example, if there's a httpstat binary inside a GOBIN directory, its
+// build info reports something like this:
 //
-//	~ Â¶ go version -m go/bin/httpstat
-//	go/bin/httpstat: devel +4de4480dc3 Fri Dec 4 22:08:54 2020 +0000
-//	    path    github.com/davecheney/httpstat
-//	    mod github.com/davecheney/httpstat  v1.0.0  h1:3o8oiYGB4AKsammYvME8tWywgLPTGUl6H75LTsKoO7w=
-//	    dep github.com/fatih/color  v1.10.0 h1:s36xzo75JdqLaaWoiEHk767eHiwo0598uUxyfiPkDsg=
-//	    dep github.com/mattn/go-colorable   v0.1.8  h1:c1ghPdyEDarC70ftn0y+A/Ee++9zz8ljHG1b13eJ0s8=
-//	    dep github.com/mattn/go-isatty  v0.0.12 h1:wuysRhFDzyxgEmMf5xjvJ2M9dZoWAXNNr5LSBS7uHXY=
-//	    dep golang.org/x/net    v0.0.0-20201202161906-c7110b5ffcbb  h1:eBmm0M9fYhWpKZLjQUUKka/LtIxf46G4fxeEz5KJr9U=
-//	    dep golang.org/x/sys    v0.0.0-20200930185726-fdedc70b468f  h1:+Nyd8tzPX9R7BWHguqsrbFdRx3WQ/1ib8I44HXV5yTA=
-//	    dep golang.org/x/text   v0.3.3  h1:cokOdA+Jmi5PJGXLlLllQSgYigAEfHXJAERHVMaCc2k=
+//	path    github.com/davecheney/httpstat
+//	mod     github.com/davecheney/httpstat  v1.0.0  h1:3o8oiYGB4AKsammYvME8tWywgLPTGUl6H75LTsKoO7w=
+//	dep     github.com/fatih/color  v1.10.0 h1:s36xzo75JdqLaaWoiEHk767eHiwo0598uUxyfiPkDsg=
+//	dep     github.com/mattn/go-colorable   v0.1.8  h1:c1ghPdyEDarC70ftn0y+A/Ee++9zz8ljHG1b13eJ0s8=
+//	dep     github.com/mattn/go-isatty  v0.0.12 h1:wuysRhFDzyxgEmMf5xjvJ2M9dZoWAXNNr5LSBS7uHXY=
+//	dep     golang.org/x/net        v0.0.0-20201202161906-c7110b5ffcbb  h1:eBmm0M9fYhWpKZLjQUUKka/LtIxf46G4fxeEz5KJr9U=
+//	dep     golang.org/x/sys        v0.0.0-20200930185726-fdedc70b468f  h1:+Nyd8tzPX9R7BWHguqsrbFdRx3WQ/1ib8I44HXV5yTA=
+//	dep     golang.org/x/text       v0.3.3  h1:cokOdA+Jmi5PJGXLlLllQSgYigAEfHXJAERHVMaCc2k=
 //
 // rebuild-gobin will then run "go install
-// github.com/davecheney/httpstat@v1.0.0" if it detects that version reported
-// by "go version" differs from one that binary was built with.
+// github.com/davecheney/httpstat@v1.0.0" if it detects that the Go version
+// reported by "go version" differs from the one the binary was built with.
 //
 // If you run this tool with "-u" flag, then it will call "go install
 // path@latest" for each binary, forcing their update to the latest available
 // version.
 //
+// Build settings recorded alongside the module information — build tags,
+// ldflags, -trimpath, CGO_ENABLED and similar — are reapplied to the "go
+// install" invocation, so a rebuilt binary matches the original as closely
+// as possible. Pass "-plain" to skip this and just run a bare "go install
+// path@version" as earlier versions of this tool did.
+//
+// Rebuilds run in parallel, up to GOMAXPROCS at a time by default; use "-j
+// N" to change the limit.
+//
+// Pass "-report file" to skip rebuilding altogether and instead write a
+// JSON inventory of every Go binary found under GOBIN — its module,
+// versions, target platform, VCS revision and full dependency list — to
+// file. This is handy for diffing GOBIN state over time or archiving a
+// manifest before running "-u".
+//
+// Binaries built for a different GOOS/GOARCH than the host (for example
+// copied in from another machine, or a shared GOBIN on a network share) are
+// skipped by default rather than risk overwriting them with a binary for
+// the wrong platform. Pass "-cross" to rebuild them anyway, targeting their
+// original GOOS/GOARCH.
+//
+// Pass "-vuln" to gate rebuilds on [govulncheck] instead of Go version: only
+// binaries whose module graph has a known vulnerability are rebuilt. Combine
+// with "-u" to also re-run govulncheck against the freshly installed binary
+// and warn if it is still vulnerable. This requires "govulncheck" to be
+// installed and on PATH.
+//
 // This tool relies on the "[go install]" semantics introduced in Go 1.16.
 //
+// [govulncheck]: https://go.dev/blog/vuln
+//
 // [go install]: https://go.dev/ref/mod#go-install
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 func main() {
 	log.SetFlags(0)
 	var upgrade bool
+	var plain bool
+	var cross bool
+	var vuln bool
+	var jobs int
+	var reportPath string
 	flag.BoolVar(&upgrade, "u", upgrade, "reinstall programs using their '@latest' version")
+	flag.BoolVar(&plain, "plain", plain, "ignore recorded build settings (tags, ldflags, trimpath, etc.) and run a bare go install")
+	flag.BoolVar(&cross, "cross", cross, "rebuild binaries for their original GOOS/GOARCH instead of skipping them")
+	flag.BoolVar(&vuln, "vuln", vuln, "only rebuild binaries govulncheck reports as vulnerable, instead of gating on Go version")
+	flag.IntVar(&jobs, "j", runtime.GOMAXPROCS(0), "number of rebuilds to run in parallel")
+	flag.StringVar(&reportPath, "report", "", "write a JSON inventory of GOBIN to `file` instead of rebuilding anything")
 	flag.Parse()
-	if err := run(upgrade); err != nil {
+	if err := run(upgrade, plain, cross, vuln, jobs, reportPath); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run(upgrade bool) error {
+// rebuildJob is a single program queued for a "go install" invocation.
+type rebuildJob struct {
+	execPath      string
+	modPath       string
+	targetVersion string
+	settings      buildSettings
+}
+
+func run(upgrade, plain, cross, vuln bool, jobs int, reportPath string) error {
+	if jobs < 1 {
+		jobs = 1
+	}
 	gobin, err := getGobin()
 	if err != nil {
 		return err
@@ -67,37 +117,87 @@ func run(upgrade bool) error {
 	if err != nil {
 		return err
 	}
-	gover, err := goVersion()
+	if reportPath != "" {
+		return writeReport(reportPath, buildReport(gobin, programs))
+	}
+	host, err := getHostInfo()
 	if err != nil {
 		return err
 	}
 	var skipped []string
-	var failed []string
-	var tempDir string
+	var mismatched []string
+	var vulnerable []string
+	var jobsToRun []rebuildJob
 	for _, p := range programs {
-		if !upgrade && p.goVersion == gover {
+		if vuln {
+			ok, err := vulnStatus(p.execPath)
+			if err != nil {
+				log.Println("govulncheck:", err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			vulnerable = append(vulnerable, p.modPath)
+		} else if !upgrade && p.goVersion == host.goVersion {
 			continue
 		}
 		if p.modVersion == "(devel)" {
-			skipped = append(skipped, p.path)
+			skipped = append(skipped, p.modPath)
 			continue
 		}
-		if tempDir == "" {
-			tempDir, err = os.MkdirTemp("", "rebuild-gobin-*")
-			if err != nil {
-				return err
+		bs := p.settings
+		if plain {
+			bs = buildSettings{}
+		}
+		if platformMismatch(p, host) {
+			if !cross {
+				mismatched = append(mismatched, p.modPath)
+				continue
 			}
-			defer os.RemoveAll(tempDir)
+			bs.env = append(bs.env, "GOOS="+p.goos, "GOARCH="+p.goarch)
 		}
 		targetVersion := p.modVersion
 		if upgrade {
 			targetVersion = "latest"
 		}
-		if err := rebuild(tempDir, fmt.Sprintf("%s@%s", p.path, targetVersion)); err != nil {
-			failed = append(failed, p.path)
+		jobsToRun = append(jobsToRun, rebuildJob{execPath: p.execPath, modPath: p.modPath, targetVersion: targetVersion, settings: bs})
+	}
+	var failed []string
+	var stillVulnerable []string
+	var rebuiltCount int
+	if len(jobsToRun) != 0 {
+		tempDir, err := os.MkdirTemp("", "rebuild-gobin-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tempDir)
+		var rebuilt []rebuildJob
+		rebuilt, failed = runJobs(tempDir, jobsToRun, jobs)
+		rebuiltCount = len(rebuilt)
+		if vuln && upgrade {
+			for _, j := range rebuilt {
+				ok, err := vulnStatus(j.execPath)
+				if err != nil {
+					log.Println("govulncheck:", err)
+					continue
+				}
+				if ok {
+					stillVulnerable = append(stillVulnerable, j.modPath)
+				}
+			}
+		}
+	}
+	if vuln {
+		log.Printf("vulnerable: %d, rebuilt: %d, still vulnerable after rebuild: %d", len(vulnerable), rebuiltCount, len(stillVulnerable))
+		if len(stillVulnerable) != 0 {
+			log.Println("The following modules are still reported vulnerable after rebuilding to @latest:")
+			for _, s := range stillVulnerable {
+				log.Println(" ", s)
+			}
 		}
 	}
-	if len(skipped) == 0 && len(failed) == 0 {
+	if len(skipped) == 0 && len(mismatched) == 0 && len(failed) == 0 {
 		return nil
 	}
 	if len(skipped) != 0 {
@@ -106,6 +206,12 @@ func run(upgrade bool) error {
 			log.Println(" ", s)
 		}
 	}
+	if len(mismatched) != 0 {
+		log.Println("Skipped the following programs because they target a different GOOS/GOARCH (use -cross to rebuild them anyway):")
+		for _, s := range mismatched {
+			log.Println(" ", s)
+		}
+	}
 	if len(failed) != 0 {
 		log.Println("There were errors installing the following modules, see the full log above:")
 		for _, s := range failed {
@@ -115,70 +221,58 @@ func run(upgrade bool) error {
 	return nil
 }
 
-func rebuild(tempDir, spec string) error {
-	if spec == "" || !strings.ContainsRune(spec, '@') {
-		return fmt.Errorf("invalid path@version spec: %q", spec)
-	}
-	cmd := exec.Command("go", "install", spec)
-	cmd.Dir = tempDir
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	log.Println("running:", cmd)
-	return cmd.Run()
-}
-
-type program struct {
-	path       string
-	modVersion string
-	goVersion  string
-}
-
-func (p *program) empty() bool { return *p == program{} }
-func (p *program) valid() bool { return p.path != "" && p.modVersion != "" && p.goVersion != "" }
-
-func inspectGobin(dir string) ([]program, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	buf, err := exec.CommandContext(ctx, "go", "version", "-m", dir).Output()
-	if err != nil {
-		return nil, err
-	}
-	var out []program
-	var current program
-	scanner := bufio.NewScanner(bytes.NewReader(buf))
-	/*
-		go/bin/tlstun: devel +4de4480dc3 Fri Dec 4 22:08:54 2020 +0000
-		path	github.com/artyom/tlstun/v2
-		mod	github.com/artyom/tlstun/v2	v2.2.1	h1:uo/Oj/63PdKuwYJ+LiAl61wefhC2CvNpDMegN+xxpmM=
-		dep	github.com/armon/go-socks5	v0.0.0-20160902184237-e75332964ef5	h1:0
-	*/
-	for scanner.Scan() {
-		text := scanner.Text()
-		if strings.HasPrefix(text, dir) {
-			if current.valid() {
-				out = append(out, current)
+// runJobs rebuilds jobsToRun using up to workers goroutines at a time, each
+// with its own temp dir under tempDir. A job's output is buffered and only
+// written to the log once the job finishes, so concurrent jobs never
+// interleave their output. It returns the jobs that installed successfully
+// and the module paths that failed to rebuild.
+func runJobs(tempDir string, jobsToRun []rebuildJob, workers int) (succeeded []rebuildJob, failed []string) {
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, workers)
+	)
+	for _, j := range jobsToRun {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(j rebuildJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			jobDir, err := os.MkdirTemp(tempDir, "job-*")
+			var buf bytes.Buffer
+			if err == nil {
+				spec := fmt.Sprintf("%s@%s", j.modPath, j.targetVersion)
+				err = rebuild(jobDir, spec, j.settings, &buf)
 			}
-			current = program{
-				goVersion: text[strings.Index(text, ": ")+2:],
+			mu.Lock()
+			io.Copy(log.Writer(), &buf)
+			if err != nil {
+				failed = append(failed, j.modPath)
+			} else {
+				succeeded = append(succeeded, j)
 			}
-			continue
-		}
-		fields := strings.Fields(text)
-		if len(fields) == 2 && fields[0] == "path" {
-			current.path = fields[1]
-			continue
-		}
-		if len(fields) >= 3 && fields[0] == "mod" {
-			current.modVersion = fields[2]
-		}
+			mu.Unlock()
+		}(j)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	wg.Wait()
+	return succeeded, failed
+}
+
+func rebuild(tempDir, spec string, bs buildSettings, out io.Writer) error {
+	if spec == "" || !strings.ContainsRune(spec, '@') {
+		return fmt.Errorf("invalid path@version spec: %q", spec)
 	}
-	if current.valid() {
-		out = append(out, current)
+	args := append([]string{"install"}, bs.installArgs()...)
+	args = append(args, spec)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = tempDir
+	if len(bs.env) != 0 {
+		cmd.Env = append(os.Environ(), bs.env...)
 	}
-	return out, nil
+	cmd.Stderr = out
+	cmd.Stdout = out
+	fmt.Fprintln(out, "running:", cmd)
+	return cmd.Run()
 }
 
 func getGobin() (string, error) {
@@ -199,24 +293,39 @@ func getGobin() (string, error) {
 	return filepath.Join(tmp.GOPATH, "bin"), nil
 }
 
-func goVersion() (string, error) {
+// hostInfo describes the toolchain and platform rebuild-gobin itself is
+// running under.
+type hostInfo struct {
+	goVersion string
+	goos      string
+	goarch    string
+}
+
+func getHostInfo() (hostInfo, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 	buf, err := exec.CommandContext(ctx, "go", "env", "-json", "GOOS", "GOARCH").Output()
 	if err != nil {
-		return "", err
+		return hostInfo{}, err
 	}
 	tmp := struct{ GOOS, GOARCH string }{}
 	if err := json.Unmarshal(buf, &tmp); err != nil {
-		return "", fmt.Errorf("cannot parse go env output: %w", err)
+		return hostInfo{}, fmt.Errorf("cannot parse go env output: %w", err)
 	}
 	buf, err = exec.CommandContext(ctx, "go", "version").Output()
 	if err != nil {
-		return "", err
+		return hostInfo{}, err
 	}
 	buf = bytes.TrimSpace(buf)
 	buf = bytes.TrimPrefix(buf, []byte("go version"))
 	buf = bytes.TrimSuffix(buf, []byte(tmp.GOOS+"/"+tmp.GOARCH))
 	buf = bytes.TrimSpace(buf)
-	return string(buf), nil
+	return hostInfo{goVersion: string(buf), goos: tmp.GOOS, goarch: tmp.GOARCH}, nil
+}
+
+// platformMismatch reports whether p targets a different GOOS/GOARCH than
+// the host described by host. A program with no recorded GOOS/GOARCH (older
+// buildinfo) is never considered mismatched.
+func platformMismatch(p program, host hostInfo) bool {
+	return (p.goos != "" && p.goos != host.goos) || (p.goarch != "" && p.goarch != host.goarch)
 }
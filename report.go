@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Report is a structured inventory of the Go binaries found under GOBIN,
+// written by "-report". Its JSON encoding is meant to be stable so other
+// tools (vulnerability scanners, diffing scripts, archival) can consume it.
+type Report struct {
+	GOBIN    string         `json:"gobin"`
+	Binaries []BinaryReport `json:"binaries"`
+}
+
+// BinaryReport describes a single binary found under GOBIN.
+type BinaryReport struct {
+	Path       string    `json:"path"`       // on-disk location
+	ModPath    string    `json:"modPath"`    // module path
+	ModVersion string    `json:"modVersion"` // module version
+	GoVersion  string    `json:"goVersion"`  // Go toolchain version it was built with
+	GOOS       string    `json:"goos"`
+	GOARCH     string    `json:"goarch"`
+	VCS        *VCSInfo  `json:"vcs,omitempty"`
+	Deps       []DepInfo `json:"deps,omitempty"`
+}
+
+// VCSInfo is the version control information embedded in a binary's build
+// info, when available.
+type VCSInfo struct {
+	Revision string `json:"revision"`
+	Time     string `json:"time"`
+	Modified bool   `json:"modified"`
+}
+
+// DepInfo is a single dependency recorded in a binary's module graph.
+type DepInfo struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"`
+}
+
+// buildReport turns the programs found under gobin into a Report.
+func buildReport(gobin string, programs []program) Report {
+	r := Report{GOBIN: gobin}
+	for _, p := range programs {
+		br := BinaryReport{
+			Path:       p.execPath,
+			ModPath:    p.modPath,
+			ModVersion: p.modVersion,
+			GoVersion:  p.goVersion,
+			GOOS:       p.goos,
+			GOARCH:     p.goarch,
+		}
+		if p.vcsRevision != "" {
+			br.VCS = &VCSInfo{Revision: p.vcsRevision, Time: p.vcsTime, Modified: p.vcsModified}
+		}
+		for _, d := range p.deps {
+			br.Deps = append(br.Deps, DepInfo{Path: d.path, Version: d.version, Sum: d.sum})
+		}
+		r.Binaries = append(r.Binaries, br)
+	}
+	return r
+}
+
+// writeReport marshals r as indented JSON and writes it to path.
+func writeReport(path string, r Report) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	return os.WriteFile(path, buf, 0o644)
+}
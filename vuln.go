@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// vulnScanTimeout bounds a single govulncheck invocation; binary-mode scans
+// can take a while on large executables.
+const vulnScanTimeout = 2 * time.Minute
+
+// vulnStatus reports whether the binary at path has a known vulnerability
+// in its module graph, according to govulncheck, which must be installed
+// and on PATH. govulncheck exits with status 3 when it finds a
+// vulnerability and 0 when it finds none; any other outcome is an error.
+func vulnStatus(path string) (vulnerable bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), vulnScanTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "govulncheck", "-mode=binary", path)
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 3:
+		return true, nil
+	default:
+		return false, fmt.Errorf("govulncheck %s: %w: %s", path, err, bytes.TrimSpace(buf.Bytes()))
+	}
+}